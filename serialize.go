@@ -1,15 +1,169 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+var (
+	loadFormatFlag = flag.String("load_format", "gob", "format used to load a dumped dep graph: json, gob, or bin")
+	saveFormatFlag = flag.String("save_format", "gob", "format used to save a dumped dep graph: json, gob, or bin")
+)
+
+// openInput opens a dep graph dump for reading. filename may be a bare
+// local path, a file:// URL, or an http(s):// URL (e.g. a dump published
+// by a build server for workers to fetch). A .gz suffix, or for
+// http(s):// a "Content-Encoding: gzip" response, is decompressed
+// transparently so callers never see compressed bytes.
+func openInput(filename string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasPrefix(filename, "http://"), strings.HasPrefix(filename, "https://"):
+		return openHTTPInput(filename)
+	default:
+		path := strings.TrimPrefix(filename, "file://")
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(path, ".gz") {
+			return gunzipReadCloser(f)
+		}
+		return f, nil
+	}
+}
+
+// createOutput creates filename for writing, the symmetric counterpart
+// of openInput: a file:// prefix is stripped, and a .gz suffix gzips the
+// stream as it's written. Dumps are only ever produced locally, so
+// http(s):// URLs aren't accepted here.
+func createOutput(filename string) (io.WriteCloser, error) {
+	if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
+		return nil, fmt.Errorf("cannot save a dep graph dump to a URL: %s", filename)
+	}
+	path := strings.TrimPrefix(filename, "file://")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(path, ".gz") {
+		return gzipWriteCloser{gzip.NewWriter(f), f}, nil
+	}
+	return f, nil
+}
+
+// gunzipReadCloser wraps r in a gzip.Reader, closing both the gzip
+// stream and r on Close.
+func gunzipReadCloser(r io.ReadCloser) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return gzipReadCloser{zr, r}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	underlying io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	if err := g.Reader.Close(); err != nil {
+		g.underlying.Close()
+		return err
+	}
+	return g.underlying.Close()
+}
+
+type gzipWriteCloser struct {
+	*gzip.Writer
+	underlying io.Closer
+}
+
+func (g gzipWriteCloser) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		g.underlying.Close()
+		return err
+	}
+	return g.underlying.Close()
+}
+
+// urlCache holds the decompressed body of dep graph dumps fetched over
+// http(s)://, keyed by URL and revalidated against the server's ETag, so
+// repeated LoadDepGraph calls for the same published artifact within one
+// process don't refetch it over the network.
+var urlCache = struct {
+	mu      sync.Mutex
+	entries map[string]urlCacheEntry
+}{entries: make(map[string]urlCacheEntry)}
+
+type urlCacheEntry struct {
+	etag string
+	body []byte
+}
+
+func openHTTPInput(rawurl string) (io.ReadCloser, error) {
+	urlCache.mu.Lock()
+	cached, haveCached := urlCache.entries[rawurl]
+	urlCache.mu.Unlock()
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if haveCached && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if haveCached && resp.StatusCode == http.StatusNotModified {
+		return ioutil.NopCloser(bytes.NewReader(cached.body)), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", rawurl, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(rawurl, ".gz") || resp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		body, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		urlCache.mu.Lock()
+		urlCache.entries[rawurl] = urlCacheEntry{etag: etag, body: body}
+		urlCache.mu.Unlock()
+	}
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
+
 type SerializableVar struct {
 	Type     string
 	V        string
@@ -17,29 +171,1252 @@ type SerializableVar struct {
 	Children []SerializableVar
 }
 
-type SerializableDepNode struct {
-	Output             int
-	Cmds               []string
-	Deps               []int
-	HasRule            bool
-	IsOrderOnly        bool
-	IsPhony            bool
-	ActualInputs       []int
-	TargetSpecificVars []int
-	Filename           string
-	Lineno             int
+type SerializableDepNode struct {
+	Output             int
+	CmdIds             []int // indices into SerializableGraph.Commands
+	Deps               []int
+	HasRule            bool
+	IsOrderOnly        bool
+	IsPhony            bool
+	ActualInputs       []int
+	TargetSpecificVars []int
+	FilenameId         int // index into SerializableGraph.Filenames
+	Lineno             int
+}
+
+// cmds resolves this node's commands against the interned pool.
+func (n *SerializableDepNode) cmds(commands []string) []string {
+	cmds := make([]string, len(n.CmdIds))
+	for i, id := range n.CmdIds {
+		cmds[i] = commands[id]
+	}
+	return cmds
+}
+
+// filename resolves this node's Makefile path against the interned pool.
+func (n *SerializableDepNode) filename(filenames []string) string {
+	return filenames[n.FilenameId]
+}
+
+type SerializableTargetSpecificVar struct {
+	Name  string
+	Value SerializableVar
+}
+
+type SerializableGraph struct {
+	Header    GraphHeader
+	Nodes     []*SerializableDepNode
+	Vars      map[string]int // name -> index into VarPool
+	VarPool   []SerializableVar
+	Tsvs      []SerializableTargetSpecificVar
+	Targets   []string
+	Commands  []string // pool of command lines referenced by SerializableDepNode.CmdIds
+	Filenames []string // pool of Makefile paths referenced by SerializableDepNode.FilenameId
+}
+
+// InputFile records the path and mtime, as seen at dump time, of a
+// Makefile that contributed to a dumped dep graph.
+type InputFile struct {
+	Filename string
+	Mtime    int64
+}
+
+type byFilename []InputFile
+
+func (s byFilename) Len() int           { return len(s) }
+func (s byFilename) Less(i, j int) bool { return s[i].Filename < s[j].Filename }
+func (s byFilename) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// GraphHeader is written alongside a dumped SerializableGraph so a later
+// load can tell whether the dump is readable by this version of kati
+// (Magic/Version), whether it has been corrupted or hand-edited (Digest),
+// and whether the Makefiles it was built from have since changed
+// (Inputs). See StaleInputs.
+type GraphHeader struct {
+	Magic   string
+	Version int
+	Digest  string
+	Inputs  []InputFile
+}
+
+const (
+	graphMagic = "KATIGRAPH"
+	// graphVersion identifies the on-disk schema the digest is computed
+	// over (node/pool layout, streaming frame, ...). Bump it whenever
+	// that schema changes, so a dump written by an older binary fails
+	// with a clear "unsupported version" error in verifyHeaderDigest
+	// instead of an opaque digest mismatch.
+	graphVersion = 2
+)
+
+// canonicalVar pairs a global variable with its name so the set can be
+// hashed in a deterministic order; SerializableGraph.Vars is a map and
+// gob/json do not guarantee stable key ordering.
+type canonicalVar struct {
+	Name  string
+	Value SerializableVar
+}
+
+// digestNode mirrors SerializableDepNode with Cmds/Filename resolved back
+// to their logical form, so the digest is the same regardless of how
+// Cmds/Filename happened to get pooled into SerializableGraph.Commands
+// and Filenames.
+type digestNode struct {
+	Output             int
+	Cmds               []string
+	Deps               []int
+	HasRule            bool
+	IsOrderOnly        bool
+	IsPhony            bool
+	ActualInputs       []int
+	TargetSpecificVars []int
+	Filename           string
+	Lineno             int
+}
+
+func resolvedDigestNodes(g SerializableGraph) []digestNode {
+	nodes := make([]digestNode, len(g.Nodes))
+	for i, n := range g.Nodes {
+		nodes[i] = digestNode{
+			Output:             n.Output,
+			Cmds:               n.cmds(g.Commands),
+			Deps:               n.Deps,
+			HasRule:            n.HasRule,
+			IsOrderOnly:        n.IsOrderOnly,
+			IsPhony:            n.IsPhony,
+			ActualInputs:       n.ActualInputs,
+			TargetSpecificVars: n.TargetSpecificVars,
+			Filename:           n.filename(g.Filenames),
+			Lineno:             n.Lineno,
+		}
+	}
+	return nodes
+}
+
+// digestFromNodes hashes the already-resolved logical content of a dep
+// graph: nodes is the same shape computeDigest would build from a
+// SerializableGraph, but callers that never assemble a full
+// SerializableGraph (e.g. BIN.SaveStreaming) can build it directly.
+func digestFromNodes(nodes []digestNode, varRefs map[string]int, varPool []SerializableVar, tsvs []SerializableTargetSpecificVar, targets []string) string {
+	vars := make(map[string]SerializableVar, len(varRefs))
+	for name, id := range varRefs {
+		vars[name] = varPool[id]
+	}
+	var names []string
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalVars := make([]canonicalVar, 0, len(names))
+	for _, name := range names {
+		canonicalVars = append(canonicalVars, canonicalVar{name, vars[name]})
+	}
+	h := sha1.New()
+	e := gob.NewEncoder(h)
+	for _, v := range []interface{}{nodes, canonicalVars, tsvs, targets} {
+		if err := e.Encode(v); err != nil {
+			panic(err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func computeDigest(g SerializableGraph) string {
+	return digestFromNodes(resolvedDigestNodes(g), g.Vars, g.VarPool, g.Tsvs, g.Targets)
+}
+
+// graphInputs records the mtimes of makefiles (the root Makefiles read
+// for this build) plus every unique filename in filenames (the pooled
+// DepNode.Filename values), deduped and sorted for deterministic output.
+func graphInputs(makefiles, filenames []string) []InputFile {
+	seen := make(map[string]bool)
+	var inputs []InputFile
+	addInput := func(filename string) {
+		if filename == "" || seen[filename] {
+			return
+		}
+		seen[filename] = true
+		var mtime int64
+		if fi, err := os.Stat(filename); err == nil {
+			mtime = fi.ModTime().Unix()
+		}
+		inputs = append(inputs, InputFile{Filename: filename, Mtime: mtime})
+	}
+	for _, mk := range makefiles {
+		addInput(mk)
+	}
+	for _, f := range filenames {
+		addInput(f)
+	}
+	sort.Sort(byFilename(inputs))
+	return inputs
+}
+
+// makeGraphHeader builds the GraphHeader for g; see graphInputs.
+func makeGraphHeader(g SerializableGraph, makefiles []string) GraphHeader {
+	return GraphHeader{
+		Magic:   graphMagic,
+		Version: graphVersion,
+		Inputs:  graphInputs(makefiles, g.Filenames),
+		Digest:  computeDigest(g),
+	}
+}
+
+// verifyHeaderDigest checks that header came from a compatible version of
+// kati and that digest, separately recomputed by the caller, matches it.
+func verifyHeaderDigest(header GraphHeader, digest string) error {
+	if header.Magic != graphMagic {
+		return fmt.Errorf("not a kati dep graph dump (bad magic %q)", header.Magic)
+	}
+	if header.Version != graphVersion {
+		return fmt.Errorf("dep graph dump has unsupported version %d, want %d", header.Version, graphVersion)
+	}
+	if digest != header.Digest {
+		return fmt.Errorf("dep graph dump failed integrity check: digest mismatch")
+	}
+	return nil
+}
+
+// verifyGraphHeader checks that g was written by a compatible version of
+// kati and has not been corrupted or hand-edited since.
+func verifyGraphHeader(g SerializableGraph) error {
+	return verifyHeaderDigest(g.Header, computeDigest(g))
+}
+
+// StaleInputs returns the Makefiles whose mtime has changed since the dep
+// graph dump at filename was written. A non-empty result means the dump
+// no longer reflects filename's inputs and should be re-evaluated rather
+// than loaded.
+func StaleInputs(filename string) ([]string, error) {
+	ls := loadSaverForFormat(*loadFormatFlag)
+	g, err := ls.Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for _, in := range g.Header.Inputs {
+		fi, err := os.Stat(in.Filename)
+		if err != nil || fi.ModTime().Unix() != in.Mtime {
+			stale = append(stale, in.Filename)
+		}
+	}
+	return stale, nil
+}
+
+// LoadSaver serializes a SerializableGraph to a file and deserializes it
+// back, using a specific on-disk encoding. DumpDepGraph/LoadDepGraph pick
+// an implementation based on --save_format/--load_format so callers don't
+// need to know which codec produced a given dump. filename may be a bare
+// local path, a file:// URL, or (Load only) an http(s):// URL; see
+// openInput/createOutput for the .gz and Content-Encoding handling
+// every implementation gets by routing through them.
+type LoadSaver interface {
+	Save(g SerializableGraph, filename string) error
+	Load(filename string) (SerializableGraph, error)
+}
+
+// StreamingLoadSaver is implemented by codecs that can dump and load a
+// dep graph without ever materializing the whole SerializableGraph in
+// memory at once. DumpDepGraph/LoadDepGraph use it in preference to
+// LoadSaver when the selected format supports it.
+type StreamingLoadSaver interface {
+	LoadSaver
+	SaveStreaming(nodes []*DepNode, vars Vars, makefiles []string, filename string) error
+	LoadStreaming(filename string) ([]*DepNode, Vars, error)
+}
+
+func loadSaverForFormat(format string) LoadSaver {
+	switch format {
+	case "json":
+		return JSON{}
+	case "gob":
+		return GOB{}
+	case "bin":
+		return BIN{}
+	default:
+		panic(fmt.Sprintf("unknown dep graph format: %q", format))
+	}
+}
+
+// JSON saves/loads a SerializableGraph as indented JSON. It is the
+// slowest and largest format, but is human readable and diffable.
+type JSON struct{}
+
+func (JSON) Save(g SerializableGraph, filename string) error {
+	o, err := json.MarshalIndent(g, " ", " ")
+	if err != nil {
+		return err
+	}
+	f, err := createOutput(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(o)
+	return err
+}
+
+func (JSON) Load(filename string) (SerializableGraph, error) {
+	f, err := openInput(filename)
+	if err != nil {
+		return SerializableGraph{}, err
+	}
+	defer f.Close()
+	g := SerializableGraph{Vars: make(map[string]int)}
+	err = json.NewDecoder(f).Decode(&g)
+	return g, err
+}
+
+// GOB saves/loads a SerializableGraph using encoding/gob. This was the
+// original and, until BIN, the only binary format.
+type GOB struct{}
+
+func (GOB) Save(g SerializableGraph, filename string) error {
+	f, err := createOutput(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(g)
+}
+
+func (GOB) Load(filename string) (SerializableGraph, error) {
+	f, err := openInput(filename)
+	if err != nil {
+		return SerializableGraph{}, err
+	}
+	defer f.Close()
+	g := SerializableGraph{Vars: make(map[string]int)}
+	err = gob.NewDecoder(f).Decode(&g)
+	return g, err
+}
+
+// BIN saves/loads a SerializableGraph with a compact custom codec: strings
+// and repeated fields are varint length-prefixed, and the ~10 character
+// type strings gob and JSON spend on every SerializableVar and
+// TargetSpecificVar op (e.g. "literal", "funcEvalAssign", "+=") are
+// replaced with a single tag byte. This noticeably shrinks dumps of large
+// graphs and is cheaper to decode than gob, since there's no reflection.
+type BIN struct{}
+
+func (BIN) Save(g SerializableGraph, filename string) error {
+	f, err := createOutput(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := writeBinGraph(w, g); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Load reads either a Save-written (binMagic) or SaveStreaming-written
+// (streamMagic) dump, collecting a streamed dump's nodes into g.Nodes so
+// callers that want the LoadSaver all-at-once contract (e.g. StaleInputs)
+// don't need to care which one produced filename. Prefer LoadStreaming
+// directly when avoiding that materialization is the point.
+func (BIN) Load(filename string) (SerializableGraph, error) {
+	f, err := openInput(filename)
+	if err != nil {
+		return SerializableGraph{}, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(len(streamMagic))
+	if err != nil {
+		return SerializableGraph{}, err
+	}
+	if string(magic) == streamMagic {
+		return readStreamedGraph(r)
+	}
+	return readBinGraph(r)
+}
+
+// readStreamedGraph reads a dump written by SaveStreaming back into a
+// single SerializableGraph; see BIN.Load.
+func readStreamedGraph(r *bufio.Reader) (SerializableGraph, error) {
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return SerializableGraph{}, err
+	}
+	if string(magic) != streamMagic {
+		return SerializableGraph{}, fmt.Errorf("not a streamed dep graph dump (bad magic %q)", magic)
+	}
+	p, err := readBinPools(r)
+	if err != nil {
+		return SerializableGraph{}, err
+	}
+	nnodes, err := binary.ReadUvarint(r)
+	if err != nil {
+		return SerializableGraph{}, err
+	}
+	g := SerializableGraph{
+		Header:    p.header,
+		VarPool:   p.varPool,
+		Vars:      p.varRefs,
+		Tsvs:      p.tsvs,
+		Targets:   p.targets,
+		Commands:  p.commands,
+		Filenames: p.filenames,
+	}
+	for i := uint64(0); i < nnodes; i++ {
+		n, err := readBinNode(r)
+		if err != nil {
+			return SerializableGraph{}, err
+		}
+		g.Nodes = append(g.Nodes, n)
+	}
+	return g, nil
+}
+
+// binVarTag maps a SerializableVar.Type or TargetSpecificVar op string to
+// the single byte BIN encodes it as.
+func binVarTag(t string) byte {
+	switch t {
+	case "literal":
+		return 'l'
+	case "tmpval":
+		return 't'
+	case "expr":
+		return 'e'
+	case "varref":
+		return 'r'
+	case "paramref":
+		return 'p'
+	case "varsubst":
+		return 's'
+	case "func":
+		return 'f'
+	case "funcEvalAssign":
+		return 'a'
+	case "funcNop":
+		return 'n'
+	case "simple":
+		return 'S'
+	case "recursive":
+		return 'R'
+	case ":=":
+		return 'T'
+	case "=":
+		return '='
+	case "+=":
+		return '+'
+	case "?=":
+		return '?'
+	default:
+		panic(fmt.Sprintf("unknown serialized variable type: %q", t))
+	}
+}
+
+func binVarType(tag byte) string {
+	switch tag {
+	case 'l':
+		return "literal"
+	case 't':
+		return "tmpval"
+	case 'e':
+		return "expr"
+	case 'r':
+		return "varref"
+	case 'p':
+		return "paramref"
+	case 's':
+		return "varsubst"
+	case 'f':
+		return "func"
+	case 'a':
+		return "funcEvalAssign"
+	case 'n':
+		return "funcNop"
+	case 'S':
+		return "simple"
+	case 'R':
+		return "recursive"
+	case 'T':
+		return ":="
+	case '=':
+		return "="
+	case '+':
+		return "+="
+	case '?':
+		return "?="
+	default:
+		panic(fmt.Sprintf("unknown BIN variable tag: %q", tag))
+	}
+}
+
+func writeBinUvarint(w io.ByteWriter, n uint64) error {
+	// binary.PutUvarint needs a slice, but we only have a ByteWriter here,
+	// so size the buffer once up front instead of allocating per call.
+	var buf [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(buf[:], n)
+	for i := 0; i < l; i++ {
+		if err := w.WriteByte(buf[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBinString(w *bufio.Writer, s string) error {
+	if err := writeBinUvarint(w, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func readBinString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func writeBinVar(w *bufio.Writer, sv SerializableVar) error {
+	if err := w.WriteByte(binVarTag(sv.Type)); err != nil {
+		return err
+	}
+	if err := writeBinString(w, sv.V); err != nil {
+		return err
+	}
+	if err := writeBinString(w, sv.Origin); err != nil {
+		return err
+	}
+	if err := writeBinUvarint(w, uint64(len(sv.Children))); err != nil {
+		return err
+	}
+	for _, c := range sv.Children {
+		if err := writeBinVar(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBinVar(r *bufio.Reader) (sv SerializableVar, err error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return sv, err
+	}
+	sv.Type = binVarType(tag)
+	if sv.V, err = readBinString(r); err != nil {
+		return sv, err
+	}
+	if sv.Origin, err = readBinString(r); err != nil {
+		return sv, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return sv, err
+	}
+	for i := uint64(0); i < n; i++ {
+		c, err := readBinVar(r)
+		if err != nil {
+			return sv, err
+		}
+		sv.Children = append(sv.Children, c)
+	}
+	return sv, nil
+}
+
+func writeBinTsv(w *bufio.Writer, tsv SerializableTargetSpecificVar) error {
+	if err := writeBinString(w, tsv.Name); err != nil {
+		return err
+	}
+	return writeBinVar(w, tsv.Value)
+}
+
+func readBinTsv(r *bufio.Reader) (tsv SerializableTargetSpecificVar, err error) {
+	if tsv.Name, err = readBinString(r); err != nil {
+		return tsv, err
+	}
+	tsv.Value, err = readBinVar(r)
+	return tsv, err
+}
+
+func writeBinIntSlice(w *bufio.Writer, ns []int) error {
+	if err := writeBinUvarint(w, uint64(len(ns))); err != nil {
+		return err
+	}
+	for _, n := range ns {
+		if err := writeBinUvarint(w, uint64(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBinIntSlice(r *bufio.Reader) (ns []int, err error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < l; i++ {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, int(n))
+	}
+	return ns, nil
+}
+
+func writeBinNode(w *bufio.Writer, n *SerializableDepNode) error {
+	if err := writeBinUvarint(w, uint64(n.Output)); err != nil {
+		return err
+	}
+	if err := writeBinIntSlice(w, n.CmdIds); err != nil {
+		return err
+	}
+	if err := writeBinIntSlice(w, n.Deps); err != nil {
+		return err
+	}
+	var flags byte
+	if n.HasRule {
+		flags |= 1
+	}
+	if n.IsOrderOnly {
+		flags |= 2
+	}
+	if n.IsPhony {
+		flags |= 4
+	}
+	if err := w.WriteByte(flags); err != nil {
+		return err
+	}
+	if err := writeBinIntSlice(w, n.ActualInputs); err != nil {
+		return err
+	}
+	if err := writeBinIntSlice(w, n.TargetSpecificVars); err != nil {
+		return err
+	}
+	if err := writeBinUvarint(w, uint64(n.FilenameId)); err != nil {
+		return err
+	}
+	return writeBinUvarint(w, uint64(n.Lineno))
+}
+
+func readBinNode(r *bufio.Reader) (n *SerializableDepNode, err error) {
+	n = &SerializableDepNode{}
+	output, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	n.Output = int(output)
+	if n.CmdIds, err = readBinIntSlice(r); err != nil {
+		return nil, err
+	}
+	if n.Deps, err = readBinIntSlice(r); err != nil {
+		return nil, err
+	}
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n.HasRule = flags&1 != 0
+	n.IsOrderOnly = flags&2 != 0
+	n.IsPhony = flags&4 != 0
+	if n.ActualInputs, err = readBinIntSlice(r); err != nil {
+		return nil, err
+	}
+	if n.TargetSpecificVars, err = readBinIntSlice(r); err != nil {
+		return nil, err
+	}
+	filenameId, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	n.FilenameId = int(filenameId)
+	lineno, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	n.Lineno = int(lineno)
+	return n, nil
+}
+
+const binMagic = "KATIBIN1"
+
+func writeBinHeader(w *bufio.Writer, h GraphHeader) error {
+	if err := writeBinString(w, h.Magic); err != nil {
+		return err
+	}
+	if err := writeBinUvarint(w, uint64(h.Version)); err != nil {
+		return err
+	}
+	if err := writeBinString(w, h.Digest); err != nil {
+		return err
+	}
+	if err := writeBinUvarint(w, uint64(len(h.Inputs))); err != nil {
+		return err
+	}
+	for _, in := range h.Inputs {
+		if err := writeBinString(w, in.Filename); err != nil {
+			return err
+		}
+		if err := writeBinUvarint(w, uint64(in.Mtime)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBinHeader(r *bufio.Reader) (h GraphHeader, err error) {
+	if h.Magic, err = readBinString(r); err != nil {
+		return h, err
+	}
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return h, err
+	}
+	h.Version = int(version)
+	if h.Digest, err = readBinString(r); err != nil {
+		return h, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return h, err
+	}
+	for i := uint64(0); i < n; i++ {
+		filename, err := readBinString(r)
+		if err != nil {
+			return h, err
+		}
+		mtime, err := binary.ReadUvarint(r)
+		if err != nil {
+			return h, err
+		}
+		h.Inputs = append(h.Inputs, InputFile{Filename: filename, Mtime: int64(mtime)})
+	}
+	return h, nil
+}
+
+func writeBinGraph(w *bufio.Writer, g SerializableGraph) error {
+	if _, err := io.WriteString(w, binMagic); err != nil {
+		return err
+	}
+	if err := writeBinHeader(w, g.Header); err != nil {
+		return err
+	}
+	if err := writeBinUvarint(w, uint64(len(g.Nodes))); err != nil {
+		return err
+	}
+	for _, n := range g.Nodes {
+		if err := writeBinNode(w, n); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(g.VarPool))); err != nil {
+		return err
+	}
+	for _, v := range g.VarPool {
+		if err := writeBinVar(w, v); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(g.Vars))); err != nil {
+		return err
+	}
+	var names []string
+	for name := range g.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeBinString(w, name); err != nil {
+			return err
+		}
+		if err := writeBinUvarint(w, uint64(g.Vars[name])); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(g.Tsvs))); err != nil {
+		return err
+	}
+	for _, tsv := range g.Tsvs {
+		if err := writeBinTsv(w, tsv); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(g.Targets))); err != nil {
+		return err
+	}
+	for _, t := range g.Targets {
+		if err := writeBinString(w, t); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(g.Commands))); err != nil {
+		return err
+	}
+	for _, c := range g.Commands {
+		if err := writeBinString(w, c); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(g.Filenames))); err != nil {
+		return err
+	}
+	for _, f := range g.Filenames {
+		if err := writeBinString(w, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBinGraph(r *bufio.Reader) (g SerializableGraph, err error) {
+	magic := make([]byte, len(binMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return g, err
+	}
+	if string(magic) != binMagic {
+		return g, fmt.Errorf("not a BIN dep graph dump (bad magic %q)", magic)
+	}
+	if g.Header, err = readBinHeader(r); err != nil {
+		return g, err
+	}
+	nnodes, err := binary.ReadUvarint(r)
+	if err != nil {
+		return g, err
+	}
+	for i := uint64(0); i < nnodes; i++ {
+		n, err := readBinNode(r)
+		if err != nil {
+			return g, err
+		}
+		g.Nodes = append(g.Nodes, n)
+	}
+	npool, err := binary.ReadUvarint(r)
+	if err != nil {
+		return g, err
+	}
+	for i := uint64(0); i < npool; i++ {
+		v, err := readBinVar(r)
+		if err != nil {
+			return g, err
+		}
+		g.VarPool = append(g.VarPool, v)
+	}
+	nvars, err := binary.ReadUvarint(r)
+	if err != nil {
+		return g, err
+	}
+	g.Vars = make(map[string]int, nvars)
+	for i := uint64(0); i < nvars; i++ {
+		name, err := readBinString(r)
+		if err != nil {
+			return g, err
+		}
+		id, err := binary.ReadUvarint(r)
+		if err != nil {
+			return g, err
+		}
+		g.Vars[name] = int(id)
+	}
+	ntsvs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return g, err
+	}
+	for i := uint64(0); i < ntsvs; i++ {
+		tsv, err := readBinTsv(r)
+		if err != nil {
+			return g, err
+		}
+		g.Tsvs = append(g.Tsvs, tsv)
+	}
+	ntargets, err := binary.ReadUvarint(r)
+	if err != nil {
+		return g, err
+	}
+	for i := uint64(0); i < ntargets; i++ {
+		t, err := readBinString(r)
+		if err != nil {
+			return g, err
+		}
+		g.Targets = append(g.Targets, t)
+	}
+	ncommands, err := binary.ReadUvarint(r)
+	if err != nil {
+		return g, err
+	}
+	g.Commands = make([]string, 0, ncommands)
+	for i := uint64(0); i < ncommands; i++ {
+		c, err := readBinString(r)
+		if err != nil {
+			return g, err
+		}
+		g.Commands = append(g.Commands, c)
+	}
+	nfilenames, err := binary.ReadUvarint(r)
+	if err != nil {
+		return g, err
+	}
+	g.Filenames = make([]string, 0, nfilenames)
+	for i := uint64(0); i < nfilenames; i++ {
+		f, err := readBinString(r)
+		if err != nil {
+			return g, err
+		}
+		g.Filenames = append(g.Filenames, f)
+	}
+	return g, nil
 }
 
-type SerializableTargetSpecificVar struct {
-	Name  string
-	Value SerializableVar
+// streamMagic marks a dep graph dump written by SaveStreaming. Unlike
+// writeBinGraph's layout, the pools are written before the nodes: a
+// streaming decoder needs Commands/Filenames/VarPool resolved before it
+// can build a *DepNode from each SerializableDepNode it reads, rather
+// than after.
+const streamMagic = "KATIBINS"
+
+// poolSection is everything SaveStreaming's two passes over the live
+// *DepNode graph can determine before a single node gets written: the
+// header (with the now fully-known digest), the interned vars, TSVs,
+// targets, commands and filenames. Nodes are streamed after it.
+type poolSection struct {
+	header    GraphHeader
+	varRefs   map[string]int
+	varPool   []SerializableVar
+	tsvs      []SerializableTargetSpecificVar
+	targets   []string
+	commands  []string
+	filenames []string
 }
 
-type SerializableGraph struct {
-	Nodes   []*SerializableDepNode
-	Vars    map[string]SerializableVar
-	Tsvs    []SerializableTargetSpecificVar
-	Targets []string
+func writeBinPools(w *bufio.Writer, p poolSection) error {
+	if err := writeBinHeader(w, p.header); err != nil {
+		return err
+	}
+	if err := writeBinUvarint(w, uint64(len(p.varPool))); err != nil {
+		return err
+	}
+	for _, v := range p.varPool {
+		if err := writeBinVar(w, v); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(p.varRefs))); err != nil {
+		return err
+	}
+	var names []string
+	for name := range p.varRefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeBinString(w, name); err != nil {
+			return err
+		}
+		if err := writeBinUvarint(w, uint64(p.varRefs[name])); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(p.tsvs))); err != nil {
+		return err
+	}
+	for _, tsv := range p.tsvs {
+		if err := writeBinTsv(w, tsv); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(p.targets))); err != nil {
+		return err
+	}
+	for _, t := range p.targets {
+		if err := writeBinString(w, t); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(p.commands))); err != nil {
+		return err
+	}
+	for _, c := range p.commands {
+		if err := writeBinString(w, c); err != nil {
+			return err
+		}
+	}
+	if err := writeBinUvarint(w, uint64(len(p.filenames))); err != nil {
+		return err
+	}
+	for _, f := range p.filenames {
+		if err := writeBinString(w, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBinPools(r *bufio.Reader) (p poolSection, err error) {
+	if p.header, err = readBinHeader(r); err != nil {
+		return p, err
+	}
+	npool, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	for i := uint64(0); i < npool; i++ {
+		v, err := readBinVar(r)
+		if err != nil {
+			return p, err
+		}
+		p.varPool = append(p.varPool, v)
+	}
+	nvars, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	p.varRefs = make(map[string]int, nvars)
+	for i := uint64(0); i < nvars; i++ {
+		name, err := readBinString(r)
+		if err != nil {
+			return p, err
+		}
+		id, err := binary.ReadUvarint(r)
+		if err != nil {
+			return p, err
+		}
+		p.varRefs[name] = int(id)
+	}
+	ntsvs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	for i := uint64(0); i < ntsvs; i++ {
+		tsv, err := readBinTsv(r)
+		if err != nil {
+			return p, err
+		}
+		p.tsvs = append(p.tsvs, tsv)
+	}
+	ntargets, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	for i := uint64(0); i < ntargets; i++ {
+		t, err := readBinString(r)
+		if err != nil {
+			return p, err
+		}
+		p.targets = append(p.targets, t)
+	}
+	ncommands, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	p.commands = make([]string, 0, ncommands)
+	for i := uint64(0); i < ncommands; i++ {
+		c, err := readBinString(r)
+		if err != nil {
+			return p, err
+		}
+		p.commands = append(p.commands, c)
+	}
+	nfilenames, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	p.filenames = make([]string, 0, nfilenames)
+	for i := uint64(0); i < nfilenames; i++ {
+		f, err := readBinString(r)
+		if err != nil {
+			return p, err
+		}
+		p.filenames = append(p.filenames, f)
+	}
+	return p, nil
+}
+
+// SaveStreaming writes the dep graph in two passes over the live
+// *DepNode graph so that no []*SerializableDepNode ever holds every node
+// at once:
+//
+//  1. walk the graph building the pools (targets, TSVs, commands,
+//     filenames), dropping each node's SerializableDepNode after copying
+//     its logical form into a digestNode; the digestNodes of all nodes
+//     are kept until the walk ends and are then hashed together into the
+//     integrity digest;
+//  2. walk it again -- cheap, since it's just the live graph already in
+//     memory -- re-serializing each node against the now-final pools and
+//     writing it straight to the encoder.
+func (BIN) SaveStreaming(nodes []*DepNode, vars Vars, makefiles []string, filename string) error {
+	ns := NewDepNodesSerializer()
+	var digestNodes []digestNode
+	numNodes := 0
+	depNodeWorklist(nodes, func(n *DepNode) {
+		sn := ns.serializeNode(n)
+		digestNodes = append(digestNodes, digestNode{
+			Output:             sn.Output,
+			Cmds:               n.Cmds,
+			Deps:               sn.Deps,
+			HasRule:            sn.HasRule,
+			IsOrderOnly:        sn.IsOrderOnly,
+			IsPhony:            sn.IsPhony,
+			ActualInputs:       sn.ActualInputs,
+			TargetSpecificVars: sn.TargetSpecificVars,
+			Filename:           n.Filename,
+			Lineno:             sn.Lineno,
+		})
+		numNodes++
+	})
+	varRefs, varPool := MakeSerializableVars(vars)
+
+	p := poolSection{
+		varRefs:   varRefs,
+		varPool:   varPool,
+		tsvs:      ns.tsvs,
+		targets:   ns.targets,
+		commands:  ns.commands,
+		filenames: ns.filenames,
+	}
+	p.header = GraphHeader{
+		Magic:   graphMagic,
+		Version: graphVersion,
+		Inputs:  graphInputs(makefiles, ns.filenames),
+		Digest:  digestFromNodes(digestNodes, varRefs, varPool, ns.tsvs, ns.targets),
+	}
+
+	f, err := createOutput(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if _, err := io.WriteString(w, streamMagic); err != nil {
+		return err
+	}
+	if err := writeBinPools(w, p); err != nil {
+		return err
+	}
+	if err := writeBinUvarint(w, uint64(numNodes)); err != nil {
+		return err
+	}
+
+	var writeErr error
+	depNodeWorklist(nodes, func(n *DepNode) {
+		if writeErr != nil {
+			return
+		}
+		writeErr = writeBinNode(w, ns.serializeNode(n))
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return w.Flush()
+}
+
+// LoadStreaming reads a dump written by SaveStreaming. Dep references
+// are integer target ids rather than *DepNode pointers, so they're
+// resolved in a second pass over an id->*DepNode map once every node has
+// been read. No []*SerializableDepNode is kept, but each node's dep ids
+// and its digestNode (for the integrity check) are held until every
+// node has been read.
+func (BIN) LoadStreaming(filename string) ([]*DepNode, Vars, error) {
+	f, err := openInput(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, nil, err
+	}
+	if string(magic) != streamMagic {
+		return nil, nil, fmt.Errorf("not a streamed dep graph dump (bad magic %q)", magic)
+	}
+	p, err := readBinPools(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	nnodes, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tsvValues := make([]Var, len(p.tsvs))
+	for i, sv := range p.tsvs {
+		tsvValues[i] = DeserializeVar(sv.Value).(Var)
+	}
+
+	nodesByTarget := make(map[int]*DepNode, nnodes)
+	depRefs := make([][]int, nnodes)
+	allNodes := make([]*DepNode, nnodes)
+	var digestNodes []digestNode
+	for i := uint64(0); i < nnodes; i++ {
+		sn, err := readBinNode(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		var actualInputs []string
+		for _, id := range sn.ActualInputs {
+			actualInputs = append(actualInputs, p.targets[id])
+		}
+		d := &DepNode{
+			Output:             p.targets[sn.Output],
+			Cmds:               sn.cmds(p.commands),
+			HasRule:            sn.HasRule,
+			IsOrderOnly:        sn.IsOrderOnly,
+			IsPhony:            sn.IsPhony,
+			ActualInputs:       actualInputs,
+			Filename:           sn.filename(p.filenames),
+			Lineno:             sn.Lineno,
+			TargetSpecificVars: make(Vars),
+		}
+		for _, id := range sn.TargetSpecificVars {
+			d.TargetSpecificVars[p.tsvs[id].Name] = tsvValues[id]
+		}
+		digestNodes = append(digestNodes, digestNode{
+			Output:             sn.Output,
+			Cmds:               d.Cmds,
+			Deps:               sn.Deps,
+			HasRule:            sn.HasRule,
+			IsOrderOnly:        sn.IsOrderOnly,
+			IsPhony:            sn.IsPhony,
+			ActualInputs:       sn.ActualInputs,
+			TargetSpecificVars: sn.TargetSpecificVars,
+			Filename:           d.Filename,
+			Lineno:             sn.Lineno,
+		})
+		nodesByTarget[sn.Output] = d
+		depRefs[i] = sn.Deps
+		allNodes[i] = d
+	}
+
+	digest := digestFromNodes(digestNodes, p.varRefs, p.varPool, p.tsvs, p.targets)
+	if err := verifyHeaderDigest(p.header, digest); err != nil {
+		return nil, nil, err
+	}
+
+	// Second pass: resolve each node's Deps via nodesByTarget now that
+	// every node has been built.
+	for i, d := range allNodes {
+		for _, depId := range depRefs[i] {
+			dep, present := nodesByTarget[depId]
+			if !present {
+				return nil, nil, fmt.Errorf("unknown target id: %d", depId)
+			}
+			d.Deps = append(d.Deps, dep)
+		}
+	}
+
+	varValues := make([]Var, len(p.varPool))
+	for i, sv := range p.varPool {
+		varValues[i] = DeserializeVar(sv).(Var)
+	}
+	vars := make(Vars, len(p.varRefs))
+	for name, id := range p.varRefs {
+		vars[name] = varValues[id]
+	}
+
+	return allNodes, vars, nil
 }
 
 func encGob(v interface{}) string {
@@ -53,19 +1430,23 @@ func encGob(v interface{}) string {
 }
 
 type DepNodesSerializer struct {
-	nodes     []*SerializableDepNode
-	tsvs      []SerializableTargetSpecificVar
-	tsvMap    map[string]int
-	targets   []string
-	targetMap map[string]int
-	done      map[string]bool
+	nodes       []*SerializableDepNode
+	tsvs        []SerializableTargetSpecificVar
+	tsvMap      map[string]int
+	targets     []string
+	targetMap   map[string]int
+	commands    []string
+	commandMap  map[string]int
+	filenames   []string
+	filenameMap map[string]int
 }
 
 func NewDepNodesSerializer() *DepNodesSerializer {
 	return &DepNodesSerializer{
-		tsvMap:    make(map[string]int),
-		targetMap: make(map[string]int),
-		done:      make(map[string]bool),
+		tsvMap:      make(map[string]int),
+		targetMap:   make(map[string]int),
+		commandMap:  make(map[string]int),
+		filenameMap: make(map[string]int),
 	}
 }
 
@@ -80,98 +1461,181 @@ func (ns *DepNodesSerializer) SerializeTarget(t string) int {
 	return id
 }
 
-func (ns *DepNodesSerializer) SerializeDepNodes(nodes []*DepNode) {
-	for _, n := range nodes {
-		if ns.done[n.Output] {
+// SerializeCommand interns a command line into ns.commands, returning the
+// same id for identical command lines, so repeated recipe text isn't
+// stored once per node.
+func (ns *DepNodesSerializer) SerializeCommand(c string) int {
+	id, present := ns.commandMap[c]
+	if present {
+		return id
+	}
+	id = len(ns.commands)
+	ns.commandMap[c] = id
+	ns.commands = append(ns.commands, c)
+	return id
+}
+
+func (ns *DepNodesSerializer) SerializeFilename(f string) int {
+	id, present := ns.filenameMap[f]
+	if present {
+		return id
+	}
+	id = len(ns.filenames)
+	ns.filenameMap[f] = id
+	ns.filenames = append(ns.filenames, f)
+	return id
+}
+
+// depNodeWorklist visits nodes and their transitive Deps exactly once,
+// breadth-first with each node visited before its Deps, via an explicit
+// queue instead of recursion —
+// large Android trees are deep enough that the old recursive walk was a
+// real stack-depth concern, and a queue is also what lets callers like
+// BIN.SaveStreaming revisit the same nodes a second time cheaply.
+func depNodeWorklist(roots []*DepNode, visit func(*DepNode)) {
+	done := make(map[string]bool)
+	queue := append([]*DepNode{}, roots...)
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if done[n.Output] {
 			continue
 		}
-		ns.done[n.Output] = true
+		done[n.Output] = true
+		visit(n)
+		queue = append(queue, n.Deps...)
+	}
+}
 
-		var deps []int
-		for _, d := range n.Deps {
-			deps = append(deps, ns.SerializeTarget(d.Output))
-		}
-		var actualInputs []int
-		for _, i := range n.ActualInputs {
-			actualInputs = append(actualInputs, ns.SerializeTarget(i))
-		}
+func (ns *DepNodesSerializer) SerializeDepNodes(nodes []*DepNode) {
+	depNodeWorklist(nodes, func(n *DepNode) {
+		ns.nodes = append(ns.nodes, ns.serializeNode(n))
+	})
+}
 
-		// Sort keys for consistent serialization.
-		var tsvKeys []string
-		for k := range n.TargetSpecificVars {
-			tsvKeys = append(tsvKeys, k)
-		}
-		sort.Strings(tsvKeys)
+// serializeNode converts a single DepNode, interning its target, TSVs,
+// commands, and filename into ns's pools. Unlike SerializeDepNodes, it
+// doesn't append to ns.nodes, so a streaming caller can write the result
+// straight to an encoder and drop it instead of accumulating every node
+// in memory at once (see BIN.SaveStreaming).
+func (ns *DepNodesSerializer) serializeNode(n *DepNode) *SerializableDepNode {
+	var deps []int
+	for _, d := range n.Deps {
+		deps = append(deps, ns.SerializeTarget(d.Output))
+	}
+	var actualInputs []int
+	for _, i := range n.ActualInputs {
+		actualInputs = append(actualInputs, ns.SerializeTarget(i))
+	}
 
-		var vars []int
-		for _, k := range tsvKeys {
-			v := n.TargetSpecificVars[k]
-			sv := SerializableTargetSpecificVar{Name: k, Value: v.Serialize()}
-			gob := encGob(sv)
-			id, present := ns.tsvMap[gob]
-			if !present {
-				id = len(ns.tsvs)
-				ns.tsvMap[gob] = id
-				ns.tsvs = append(ns.tsvs, sv)
-			}
-			vars = append(vars, id)
+	// Sort keys for consistent serialization.
+	var tsvKeys []string
+	for k := range n.TargetSpecificVars {
+		tsvKeys = append(tsvKeys, k)
+	}
+	sort.Strings(tsvKeys)
+
+	var vars []int
+	for _, k := range tsvKeys {
+		v := n.TargetSpecificVars[k]
+		sv := SerializableTargetSpecificVar{Name: k, Value: v.Serialize()}
+		gob := encGob(sv)
+		id, present := ns.tsvMap[gob]
+		if !present {
+			id = len(ns.tsvs)
+			ns.tsvMap[gob] = id
+			ns.tsvs = append(ns.tsvs, sv)
 		}
+		vars = append(vars, id)
+	}
 
-		ns.nodes = append(ns.nodes, &SerializableDepNode{
-			Output:             ns.SerializeTarget(n.Output),
-			Cmds:               n.Cmds,
-			Deps:               deps,
-			HasRule:            n.HasRule,
-			IsOrderOnly:        n.IsOrderOnly,
-			IsPhony:            n.IsPhony,
-			ActualInputs:       actualInputs,
-			TargetSpecificVars: vars,
-			Filename:           n.Filename,
-			Lineno:             n.Lineno,
-		})
-		ns.SerializeDepNodes(n.Deps)
+	cmdIds := make([]int, 0, len(n.Cmds))
+	for _, c := range n.Cmds {
+		cmdIds = append(cmdIds, ns.SerializeCommand(c))
+	}
+
+	return &SerializableDepNode{
+		Output:             ns.SerializeTarget(n.Output),
+		CmdIds:             cmdIds,
+		Deps:               deps,
+		HasRule:            n.HasRule,
+		IsOrderOnly:        n.IsOrderOnly,
+		IsPhony:            n.IsPhony,
+		ActualInputs:       actualInputs,
+		TargetSpecificVars: vars,
+		FilenameId:         ns.SerializeFilename(n.Filename),
+		Lineno:             n.Lineno,
 	}
 }
 
-func MakeSerializableVars(vars Vars) (r map[string]SerializableVar) {
-	r = make(map[string]SerializableVar)
+// MakeSerializableVars serializes vars into a pool of unique values plus
+// a name->index map, since inherited environment variables are commonly
+// byte-identical across many names.
+func MakeSerializableVars(vars Vars) (varRefs map[string]int, varPool []SerializableVar) {
+	varRefs = make(map[string]int)
+	varMap := make(map[string]int)
 	for k, v := range vars {
-		r[k] = v.Serialize()
+		sv := v.Serialize()
+		gob := encGob(sv)
+		id, present := varMap[gob]
+		if !present {
+			id = len(varPool)
+			varMap[gob] = id
+			varPool = append(varPool, sv)
+		}
+		varRefs[k] = id
 	}
-	return r
+	return varRefs, varPool
 }
 
 func MakeSerializableGraph(nodes []*DepNode, vars Vars) SerializableGraph {
 	ns := NewDepNodesSerializer()
 	ns.SerializeDepNodes(nodes)
-	v := MakeSerializableVars(vars)
+	varRefs, varPool := MakeSerializableVars(vars)
 	return SerializableGraph{
-		Nodes: ns.nodes,
-		Vars: v,
-		Tsvs: ns.tsvs,
-		Targets: ns.targets,
+		Nodes:     ns.nodes,
+		Vars:      varRefs,
+		VarPool:   varPool,
+		Tsvs:      ns.tsvs,
+		Targets:   ns.targets,
+		Commands:  ns.commands,
+		Filenames: ns.filenames,
 	}
 }
 
-func DumpDepGraphAsJson(nodes []*DepNode, vars Vars, filename string) {
-	o, err := json.MarshalIndent(MakeSerializableGraph(nodes, vars), " ", " ")
+// DumpDepGraphAsJson writes the dep graph as JSON, regardless of
+// --save_format. It is kept for callers that specifically want a
+// human-readable dump (e.g. "--dump_json"). makefiles are the root
+// Makefiles read for this build; they, plus every DepNode.Filename, are
+// recorded in the header so a later StaleInputs call can detect edits.
+func DumpDepGraphAsJson(nodes []*DepNode, vars Vars, makefiles []string, filename string) {
+	g := MakeSerializableGraph(nodes, vars)
+	g.Header = makeGraphHeader(g, makefiles)
+	err := (JSON{}).Save(g, filename)
 	if err != nil {
 		panic(err)
 	}
-	f, err2 := os.Create(filename)
-	if err2 != nil {
-		panic(err2)
-	}
-	f.Write(o)
 }
 
-func DumpDepGraph(nodes []*DepNode, vars Vars, filename string) {
-	f, err := os.Create(filename)
+// DumpDepGraph writes the dep graph using the codec named by
+// --save_format (gob by default). makefiles are the root Makefiles read
+// for this build; see DumpDepGraphAsJson. If the selected codec is a
+// StreamingLoadSaver, its SaveStreaming is used instead of Save so the
+// whole graph is never held in memory as a single SerializableGraph.
+func DumpDepGraph(nodes []*DepNode, vars Vars, makefiles []string, filename string) {
+	ls := loadSaverForFormat(*saveFormatFlag)
+	if sls, ok := ls.(StreamingLoadSaver); ok {
+		if err := sls.SaveStreaming(nodes, vars, makefiles, filename); err != nil {
+			panic(err)
+		}
+		return
+	}
+	g := MakeSerializableGraph(nodes, vars)
+	g.Header = makeGraphHeader(g, makefiles)
+	err := ls.Save(g, filename)
 	if err != nil {
 		panic(err)
 	}
-	e := gob.NewEncoder(f)
-	e.Encode(MakeSerializableGraph(nodes, vars))
 }
 
 func DeserializeSingleChild(sv SerializableVar) Value {
@@ -248,10 +1712,16 @@ func DeserializeVar(sv SerializableVar) (r Value) {
 	return UndefinedVar{}
 }
 
-func DeserializeVars(vars map[string]SerializableVar) Vars {
+// DeserializeVars resolves g.Vars/g.VarPool back into a Vars, sharing the
+// deserialized Var for every name that pooled to the same value.
+func DeserializeVars(g SerializableGraph) Vars {
+	values := make([]Var, len(g.VarPool))
+	for i, sv := range g.VarPool {
+		values[i] = DeserializeVar(sv).(Var)
+	}
 	r := make(Vars)
-	for k, v := range vars {
-		r[k] = DeserializeVar(v).(Var)
+	for k, id := range g.Vars {
+		r[k] = values[id]
 	}
 	return r
 }
@@ -275,12 +1745,12 @@ func DeserializeNodes(g SerializableGraph) (r []*DepNode) {
 
 		d := &DepNode{
 			Output:             targets[n.Output],
-			Cmds:               n.Cmds,
+			Cmds:               n.cmds(g.Commands),
 			HasRule:            n.HasRule,
 			IsOrderOnly:        n.IsOrderOnly,
 			IsPhony:            n.IsPhony,
 			ActualInputs:       actualInputs,
-			Filename:           n.Filename,
+			Filename:           n.filename(g.Filenames),
 			Lineno:             n.Lineno,
 			TargetSpecificVars: make(Vars),
 		}
@@ -309,29 +1779,31 @@ func DeserializeNodes(g SerializableGraph) (r []*DepNode) {
 }
 
 func human(n int) string {
-	if n >= 10 * 1000 * 1000 * 1000 {
-		return fmt.Sprintf("%.2fGB", float32(n) / 1000 / 1000 / 1000)
-	} else if n >= 10 * 1000 * 1000 {
-		return fmt.Sprintf("%.2fMB", float32(n) / 1000 / 1000)
-	} else if n >= 10 * 1000 {
-		return fmt.Sprintf("%.2fkB", float32(n) / 1000)
+	if n >= 10*1000*1000*1000 {
+		return fmt.Sprintf("%.2fGB", float32(n)/1000/1000/1000)
+	} else if n >= 10*1000*1000 {
+		return fmt.Sprintf("%.2fMB", float32(n)/1000/1000)
+	} else if n >= 10*1000 {
+		return fmt.Sprintf("%.2fkB", float32(n)/1000)
 	} else {
 		return fmt.Sprintf("%dB", n)
 	}
 }
 
-func showSerializedNodesStats(nodes []*SerializableDepNode) {
+func showSerializedNodesStats(nodes []*SerializableDepNode, commands, filenames []string) {
 	outputSize := 0
-	cmdSize := 0
+	cmdRefSize := 0
+	cmdRefs := 0
 	depsSize := 0
 	actualInputSize := 0
 	tsvSize := 0
-	filenameSize := 0
+	filenameRefSize := 0
 	linenoSize := 0
 	for _, n := range nodes {
 		outputSize += 4
-		for _, c := range n.Cmds {
-			cmdSize += len(c)
+		for range n.CmdIds {
+			cmdRefSize += 4
+			cmdRefs++
 		}
 		for _ = range n.Deps {
 			depsSize += 4
@@ -342,20 +1814,39 @@ func showSerializedNodesStats(nodes []*SerializableDepNode) {
 		for _ = range n.TargetSpecificVars {
 			tsvSize += 4
 		}
-		filenameSize += len(n.Filename)
+		filenameRefSize += 4
 		linenoSize += 4
 	}
+	cmdPoolSize := 0
+	for _, c := range commands {
+		cmdPoolSize += len(c)
+	}
+	filenamePoolSize := 0
+	for _, f := range filenames {
+		filenamePoolSize += len(f)
+	}
+	cmdSize := cmdRefSize + cmdPoolSize
+	filenameSize := filenameRefSize + filenamePoolSize
 	size := outputSize + cmdSize + depsSize + actualInputSize + tsvSize + filenameSize + linenoSize
 	LogStats("%d nodes %s", len(nodes), human(size))
 	LogStats(" output %s", human(outputSize))
-	LogStats(" command %s", human(cmdSize))
+	LogStats(" command %s (%d unique, dedup ratio %.1fx)", human(cmdSize), len(commands), dedupRatio(cmdRefs, len(commands)))
 	LogStats(" deps %s", human(depsSize))
 	LogStats(" inputs %s", human(actualInputSize))
 	LogStats(" tsv %s", human(tsvSize))
-	LogStats(" filename %s", human(filenameSize))
+	LogStats(" filename %s (%d unique, dedup ratio %.1fx)", human(filenameSize), len(filenames), dedupRatio(len(nodes), len(filenames)))
 	LogStats(" lineno %s", human(linenoSize))
 }
 
+// dedupRatio reports how many references (e.g. per-node command or
+// filename ids) share each pooled value on average.
+func dedupRatio(refs, uniq int) float64 {
+	if uniq == 0 {
+		return 0
+	}
+	return float64(refs) / float64(uniq)
+}
+
 func (v SerializableVar) size() int {
 	size := 0
 	size += len(v.Type)
@@ -367,17 +1858,21 @@ func (v SerializableVar) size() int {
 	return size
 }
 
-func showSerializedVarsStats(vars map[string]SerializableVar) {
+func showSerializedVarsStats(vars map[string]int, varPool []SerializableVar) {
 	nameSize := 0
-	valueSize := 0
-	for k, v := range vars {
+	refSize := 0
+	for k := range vars {
 		nameSize += len(k)
-		valueSize += v.size()
+		refSize += 4
 	}
-	size := nameSize + valueSize
+	poolSize := 0
+	for _, v := range varPool {
+		poolSize += v.size()
+	}
+	size := nameSize + refSize + poolSize
 	LogStats("%d vars %s", len(vars), human(size))
 	LogStats(" name %s", human(nameSize))
-	LogStats(" value %s", human(valueSize))
+	LogStats(" value %s (%d unique, dedup ratio %.1fx)", human(refSize+poolSize), len(varPool), dedupRatio(len(vars), len(varPool)))
 }
 
 func showSerializedTsvsStats(vars []SerializableTargetSpecificVar) {
@@ -402,8 +1897,8 @@ func showSerializedTargetsStats(targets []string) {
 }
 
 func showSerializedGraphStats(g SerializableGraph) {
-	showSerializedNodesStats(g.Nodes)
-	showSerializedVarsStats(g.Vars)
+	showSerializedNodesStats(g.Nodes, g.Commands, g.Filenames)
+	showSerializedVarsStats(g.Vars, g.VarPool)
 	showSerializedTsvsStats(g.Tsvs)
 	showSerializedTargetsStats(g.Targets)
 }
@@ -413,36 +1908,48 @@ func DeserializeGraph(g SerializableGraph) ([]*DepNode, Vars) {
 		showSerializedGraphStats(g)
 	}
 	nodes := DeserializeNodes(g)
-	vars := DeserializeVars(g.Vars)
+	vars := DeserializeVars(g)
 	return nodes, vars
 }
 
+// LoadDepGraphFromJson loads a dep graph dump written by
+// DumpDepGraphAsJson, regardless of --load_format. It refuses to load a
+// dump with a missing/mismatched magic, an unsupported version, or a
+// digest that doesn't match its contents.
 func LoadDepGraphFromJson(filename string) ([]*DepNode, Vars) {
-	f, err := os.Open(filename)
+	g, err := (JSON{}).Load(filename)
 	if err != nil {
 		panic(err)
 	}
-
-	d := json.NewDecoder(f)
-	g := SerializableGraph{Vars: make(map[string]SerializableVar)}
-	err = d.Decode(&g)
-	if err != nil {
+	if err := verifyGraphHeader(g); err != nil {
 		panic(err)
 	}
 	return DeserializeGraph(g)
 }
 
+// LoadDepGraph loads a dep graph dump using the codec named by
+// --load_format (gob by default). See LoadDepGraphFromJson for the
+// integrity checks it performs before returning. If the selected codec
+// is a StreamingLoadSaver, its LoadStreaming is used instead of Load, so
+// the dump is never held in memory as a single SerializableGraph
+// alongside the *DepNode graph being built from it. Note that this skips
+// the --log/--stats dump size breakdown DeserializeGraph would otherwise
+// print, since that needs the SerializableGraph form.
 func LoadDepGraph(filename string) ([]*DepNode, Vars) {
-	f, err := os.Open(filename)
+	ls := loadSaverForFormat(*loadFormatFlag)
+	if sls, ok := ls.(StreamingLoadSaver); ok {
+		nodes, vars, err := sls.LoadStreaming(filename)
+		if err != nil {
+			panic(err)
+		}
+		return nodes, vars
+	}
+	g, err := ls.Load(filename)
 	if err != nil {
 		panic(err)
 	}
-
-	d := gob.NewDecoder(f)
-	g := SerializableGraph{Vars: make(map[string]SerializableVar)}
-	err = d.Decode(&g)
-	if err != nil {
+	if err := verifyGraphHeader(g); err != nil {
 		panic(err)
 	}
 	return DeserializeGraph(g)
-}
\ No newline at end of file
+}
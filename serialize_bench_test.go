@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchGraph returns a synthetic linear chain of n dep nodes sharing a
+// Makefile and a couple of recipe lines, for comparing the memory cost
+// of DumpDepGraph's materialized and streaming save paths.
+func benchGraph(n int) ([]*DepNode, Vars) {
+	nodes := make([]*DepNode, n)
+	var prev *DepNode
+	for i := 0; i < n; i++ {
+		d := &DepNode{
+			Output:             fmt.Sprintf("out/obj%d.o", i),
+			Cmds:               []string{"cc -c -o $@ $<", "strip $@"},
+			Filename:           "build.mk",
+			Lineno:             i + 1,
+			TargetSpecificVars: make(Vars),
+		}
+		if prev != nil {
+			d.Deps = []*DepNode{prev}
+		}
+		nodes[i] = d
+		prev = d
+	}
+	return nodes, Vars{}
+}
+
+// These benchmarks compare BIN.Save, which materializes the whole
+// SerializableGraph before writing it, against BIN.SaveStreaming, which
+// never builds a []*SerializableDepNode the size of the whole graph.
+// There's no RSS sampler in this tree, so they report bytes/op under
+// -benchmem (b.ReportAllocs), which counts total allocation rather than
+// peak memory. SaveStreaming serializes every node twice and keeps a
+// digestNode per node until its first pass ends, so its bytes/op can
+// exceed Save's.
+
+func BenchmarkDumpDepGraphMaterialized(b *testing.B) {
+	nodes, vars := benchGraph(2000)
+	dir, err := ioutil.TempDir("", "kati-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "graph.bin")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		g := MakeSerializableGraph(nodes, vars)
+		g.Header = makeGraphHeader(g, []string{"build.mk"})
+		if err := (BIN{}).Save(g, filename); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDumpDepGraphStreaming(b *testing.B) {
+	nodes, vars := benchGraph(2000)
+	dir, err := ioutil.TempDir("", "kati-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "graph.bin")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := (BIN{}).SaveStreaming(nodes, vars, []string{"build.mk"}, filename); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
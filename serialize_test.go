@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// nodeOutputs returns the Output of each node, in order, for comparing
+// round-tripped graphs without relying on pointer identity.
+func nodeOutputs(nodes []*DepNode) []string {
+	outputs := make([]string, len(nodes))
+	for i, n := range nodes {
+		outputs[i] = n.Output
+	}
+	return outputs
+}
+
+func tempGraphFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kati-serialize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "graph.out")
+}
+
+func TestBINSaveLoadRoundTrip(t *testing.T) {
+	nodes, vars := benchGraph(5)
+	g := MakeSerializableGraph(nodes, vars)
+	g.Header = makeGraphHeader(g, []string{"build.mk"})
+
+	filename := tempGraphFile(t)
+	if err := (BIN{}).Save(g, filename); err != nil {
+		t.Fatal(err)
+	}
+	got, err := (BIN{}).Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyGraphHeader(got); err != nil {
+		t.Errorf("verifyGraphHeader: %v", err)
+	}
+	if len(got.Nodes) != len(g.Nodes) {
+		t.Fatalf("got %d nodes, want %d", len(got.Nodes), len(g.Nodes))
+	}
+	if !reflect.DeepEqual(got.Commands, g.Commands) {
+		t.Errorf("Commands = %v, want %v", got.Commands, g.Commands)
+	}
+	if !reflect.DeepEqual(got.Filenames, g.Filenames) {
+		t.Errorf("Filenames = %v, want %v", got.Filenames, g.Filenames)
+	}
+	for i, n := range got.Nodes {
+		if !reflect.DeepEqual(n.cmds(got.Commands), g.Nodes[i].cmds(g.Commands)) {
+			t.Errorf("node %d cmds = %v, want %v", i, n.cmds(got.Commands), g.Nodes[i].cmds(g.Commands))
+		}
+		if n.filename(got.Filenames) != g.Nodes[i].filename(g.Filenames) {
+			t.Errorf("node %d filename = %q, want %q", i, n.filename(got.Filenames), g.Nodes[i].filename(g.Filenames))
+		}
+	}
+}
+
+func TestGOBSaveLoadRoundTrip(t *testing.T) {
+	nodes, vars := benchGraph(5)
+	g := MakeSerializableGraph(nodes, vars)
+	g.Header = makeGraphHeader(g, []string{"build.mk"})
+
+	filename := tempGraphFile(t)
+	if err := (GOB{}).Save(g, filename); err != nil {
+		t.Fatal(err)
+	}
+	got, err := (GOB{}).Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyGraphHeader(got); err != nil {
+		t.Errorf("verifyGraphHeader: %v", err)
+	}
+	if !reflect.DeepEqual(got, g) {
+		t.Errorf("GOB round trip changed the graph:\ngot:  %+v\nwant: %+v", got, g)
+	}
+}
+
+func TestJSONSaveLoadRoundTrip(t *testing.T) {
+	nodes, vars := benchGraph(5)
+	g := MakeSerializableGraph(nodes, vars)
+	g.Header = makeGraphHeader(g, []string{"build.mk"})
+
+	filename := tempGraphFile(t)
+	if err := (JSON{}).Save(g, filename); err != nil {
+		t.Fatal(err)
+	}
+	got, err := (JSON{}).Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyGraphHeader(got); err != nil {
+		t.Errorf("verifyGraphHeader: %v", err)
+	}
+	if !reflect.DeepEqual(got, g) {
+		t.Errorf("JSON round trip changed the graph:\ngot:  %+v\nwant: %+v", got, g)
+	}
+}
+
+func TestBINSaveLoadStreamingRoundTrip(t *testing.T) {
+	nodes, vars := benchGraph(5)
+	filename := tempGraphFile(t)
+	if err := (BIN{}).SaveStreaming(nodes, vars, []string{"build.mk"}, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	gotNodes, gotVars, err := (BIN{}).LoadStreaming(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nodeOutputs(gotNodes), nodeOutputs(nodes)) {
+		t.Errorf("node outputs = %v, want %v", nodeOutputs(gotNodes), nodeOutputs(nodes))
+	}
+	for i, n := range gotNodes {
+		want := nodes[i]
+		if !reflect.DeepEqual(n.Cmds, want.Cmds) {
+			t.Errorf("node %d Cmds = %v, want %v", i, n.Cmds, want.Cmds)
+		}
+		if n.Filename != want.Filename {
+			t.Errorf("node %d Filename = %q, want %q", i, n.Filename, want.Filename)
+		}
+		if len(n.Deps) != len(want.Deps) {
+			t.Errorf("node %d has %d deps, want %d", i, len(n.Deps), len(want.Deps))
+		}
+	}
+	if len(gotVars) != len(vars) {
+		t.Errorf("got %d vars, want %d", len(gotVars), len(vars))
+	}
+
+	// BIN.Load must also be able to read a streamed dump, since
+	// StaleInputs reads a --load_format=bin dump through LoadSaver.Load
+	// rather than LoadStreaming.
+	g, err := (BIN{}).Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyGraphHeader(g); err != nil {
+		t.Errorf("verifyGraphHeader: %v", err)
+	}
+	if len(g.Nodes) != len(nodes) {
+		t.Errorf("got %d nodes, want %d", len(g.Nodes), len(nodes))
+	}
+}